@@ -30,6 +30,8 @@ import (
 	"strconv"
 	"sync"
 
+	dbzip2 "github.com/dsnet/compress/bzip2"
+
 	"github.com/containerd/log"
 	"github.com/klauspost/compress/zstd"
 )
@@ -52,6 +54,105 @@ const (
 	Xz
 )
 
+// Options carries tunables for a Type's Compress method, such as the
+// compression level. Zero values mean "use the format's default".
+type Options struct {
+	// Level is the format-specific compression level. A value of 0 means
+	// the default level for the algorithm.
+	Level int
+	// Concurrency is the number of workers (goroutines, or threads in an
+	// external encoder such as pigz) used to compress in parallel. 1 means
+	// single-threaded. 0 means single-threaded for the in-process gzip
+	// encoder, while the zstd encoder and pigz then use their own default
+	// worker counts. Formats that don't support parallel encoding ignore
+	// this field.
+	Concurrency int
+	// BlockSize is the uncompressed size of each block that the in-process
+	// gzip encoder compresses independently when Concurrency > 1, and the
+	// chunk size of ZstdChunked. 0 selects a format-specific default.
+	BlockSize int
+}
+
+// Type describes a compression algorithm that can be plugged into this
+// package's DetectCompression/DecompressStream/CompressStream without
+// editing this package. Built-in formats (gzip, zstd, bzip2, xz) are
+// registered this way at init time; out-of-tree code can Register
+// additional formats, e.g. lz4 or brotli, the same way.
+type Type interface {
+	// Name identifies the algorithm, e.g. "gzip".
+	Name() string
+	// Extension returns the file extension conventionally used for this
+	// algorithm, e.g. "gz", without a leading dot.
+	Extension() string
+	// Magic returns the leading byte sequence used to detect this format.
+	// It is informational; Match is what DetectCompression actually calls.
+	Magic() []byte
+	// Match reports whether source, a prefix of the stream, looks like
+	// this algorithm.
+	Match(source []byte) bool
+	// Decompress returns a reader that decompresses r.
+	Decompress(r io.Reader) (io.ReadCloser, error)
+	// Compress returns a writer that compresses into w.
+	Compress(w io.Writer, opts Options) (io.WriteCloser, error)
+}
+
+type registryEntry struct {
+	id Compression
+	t  Type
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[Compression]Type{}
+	// registryOrder holds the same entries as registry, in registration
+	// order. DetectCompression scans this slice rather than the map so that
+	// two Types whose Match both report true for the same input resolve
+	// deterministically, to whichever was registered first, instead of
+	// depending on Go's randomized map iteration order.
+	registryOrder []registryEntry
+	nextID        = Xz + 1
+)
+
+// Register adds a Type to the set consulted by DetectCompression,
+// DecompressStream and CompressStream, and returns the Compression value
+// it was assigned. Registering the same Type more than once assigns it a
+// new value each time.
+//
+// If t's Match overlaps an already-registered Type's Match for some input,
+// DetectCompression resolves the ambiguity in registration order: whichever
+// of the two was registered first wins.
+func Register(t Type) Compression {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	id := nextID
+	nextID++
+	registry[id] = t
+	registryOrder = append(registryOrder, registryEntry{id, t})
+	return id
+}
+
+func registerBuiltin(id Compression, t Type) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[id] = t
+	registryOrder = append(registryOrder, registryEntry{id, t})
+}
+
+func lookup(c Compression) (Type, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	t, ok := registry[c]
+	return t, ok
+}
+
+func init() {
+	registerBuiltin(Gzip, gzipType{})
+	registerBuiltin(Zstd, zstdType{})
+	registerBuiltin(Bzip2, bzip2Type{})
+	registerBuiltin(Xz, xzType{})
+}
+
 const (
 	disablePigzEnv  = "CONTAINERD_DISABLE_PIGZ"
 	disableIgzipEnv = "CONTAINERD_DISABLE_IGZIP"
@@ -175,16 +276,16 @@ func zstdMatcher() matcher {
 	}
 }
 
-// DetectCompression detects the compression algorithm of the source.
+// DetectCompression detects the compression algorithm of the source. If more
+// than one registered Type matches, the one registered first wins; see
+// Register.
 func DetectCompression(source []byte) Compression {
-	for compression, fn := range map[Compression]matcher{
-		Gzip:  magicNumberMatcher(gzipMagic),
-		Zstd:  zstdMatcher(),
-		Bzip2: magicNumberMatcher(bzip2Magic),
-		Xz:    magicNumberMatcher(xzMagic),
-	} {
-		if fn(source) {
-			return compression
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	for _, entry := range registryOrder {
+		if entry.t.Match(source) {
+			return entry.id
 		}
 	}
 	return Uncompressed
@@ -204,97 +305,209 @@ func DecompressStream(archive io.Reader) (DecompressReadCloser, error) {
 		return nil, err
 	}
 
-	switch compression := DetectCompression(bs); compression {
-	case Uncompressed:
+	compression := DetectCompression(bs)
+	if compression == Uncompressed {
 		return &readCloserWrapper{
 			Reader:      buf,
 			compression: compression,
 		}, nil
-	case Gzip:
-		ctx, cancel := context.WithCancel(context.Background())
-		gzReader, err := gzipDecompress(ctx, buf)
-		if err != nil {
-			cancel()
-			return nil, err
-		}
-
-		return &readCloserWrapper{
-			Reader:      gzReader,
-			compression: compression,
-			closer: func() error {
-				cancel()
-				return gzReader.Close()
-			},
-		}, nil
-	case Zstd:
-		zstdReader, err := zstd.NewReader(buf)
-		if err != nil {
-			return nil, err
-		}
-		return &readCloserWrapper{
-			Reader:      zstdReader,
-			compression: compression,
-			closer: func() error {
-				zstdReader.Close()
-				return nil
-			},
-		}, nil
-	case Xz:
-		ctx, cancel := context.WithCancel(context.Background())
-		xzReader, err := xzDecompress(ctx, buf)
-		if err != nil {
-			cancel()
-			return nil, err
-		}
-		return &readCloserWrapper{
-			Reader:      xzReader,
-			compression: compression,
-			closer: func() error {
-				cancel()
-				return xzReader.Close()
-			},
-		}, nil
-	case Bzip2:
-		bzip2Reader := bzip2.NewReader(buf)
-		if err != nil {
-			return nil, err
-		}
-		return &readCloserWrapper{
-			Reader:      bzip2Reader,
-			compression: compression,
-			closer: func() error {
-				return nil
-			},
-		}, nil
+	}
 
-	default:
+	t, ok := lookup(compression)
+	if !ok {
 		return nil, fmt.Errorf("unsupported compression format %s", (&compression).Extension())
 	}
+
+	rc, err := t.Decompress(buf)
+	if err != nil {
+		return nil, err
+	}
+	return &readCloserWrapper{
+		Reader:      rc,
+		compression: compression,
+		closer:      rc.Close,
+	}, nil
 }
 
 // CompressStream compresses the dest with specified compression algorithm.
 func CompressStream(dest io.Writer, compression Compression) (io.WriteCloser, error) {
-	switch compression {
-	case Uncompressed:
+	return CompressStreamWithOptions(dest, compression, Options{})
+}
+
+// CompressStreamWithOptions compresses dest with the specified compression
+// algorithm. opts.Level is honored by the built-in gzip, zstd, bzip2 and xz
+// encoders; ZstdChunked ignores it. opts.Concurrency is honored by gzip and
+// zstd. opts.BlockSize is honored by the in-process parallel gzip encoder
+// and by ZstdChunked; zstd and pigz ignore it.
+func CompressStreamWithOptions(dest io.Writer, compression Compression, opts Options) (io.WriteCloser, error) {
+	if compression == Uncompressed {
 		return &writeCloserWrapper{dest, nil}, nil
-	case Gzip:
-		return gzip.NewWriter(dest), nil
-	case Zstd:
-		return zstd.NewWriter(dest)
-	default:
+	}
+
+	t, ok := lookup(compression)
+	if !ok {
 		return nil, fmt.Errorf("unsupported compression format %s", (&compression).Extension())
 	}
+	return t.Compress(dest, opts)
 }
 
 // Extension returns the extension of a file that uses the specified compression algorithm.
 func (compression *Compression) Extension() string {
-	switch *compression {
-	case Gzip:
-		return "gz"
-	case Zstd:
-		return "zst"
+	t, ok := lookup(*compression)
+	if !ok {
+		return ""
+	}
+	return t.Extension()
+}
+
+// gzipType is the built-in Type registration for gzip.
+type gzipType struct{}
+
+func (gzipType) Name() string      { return "gzip" }
+func (gzipType) Extension() string { return "gz" }
+func (gzipType) Magic() []byte     { return gzipMagic }
+
+func (gzipType) Match(source []byte) bool {
+	return magicNumberMatcher(gzipMagic)(source)
+}
+
+func (gzipType) Decompress(r io.Reader) (io.ReadCloser, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	gzReader, err := gzipDecompress(ctx, r)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &readCloserWrapper{
+		Reader: gzReader,
+		closer: func() error {
+			cancel()
+			return gzReader.Close()
+		},
+	}, nil
+}
+
+func (gzipType) Compress(w io.Writer, opts Options) (io.WriteCloser, error) {
+	if path := gzipCompressCommand(); path != "" {
+		return gzipCompressExternal(path, w, opts)
+	}
+	if opts.Concurrency > 1 {
+		return newParallelGzipWriter(w, opts), nil
+	}
+	if opts.Level != 0 {
+		return gzip.NewWriterLevel(w, opts.Level)
+	}
+	return gzip.NewWriter(w), nil
+}
+
+// zstdType is the built-in Type registration for zstd.
+type zstdType struct{}
+
+func (zstdType) Name() string      { return "zstd" }
+func (zstdType) Extension() string { return "zst" }
+func (zstdType) Magic() []byte     { return zstdMagic }
+
+func (zstdType) Match(source []byte) bool {
+	return zstdMatcher()(source)
+}
+
+func (zstdType) Decompress(r io.Reader) (io.ReadCloser, error) {
+	zstdReader, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return &readCloserWrapper{
+		Reader: zstdReader,
+		closer: func() error {
+			zstdReader.Close()
+			return nil
+		},
+	}, nil
+}
+
+func (zstdType) Compress(w io.Writer, opts Options) (io.WriteCloser, error) {
+	var zopts []zstd.EOption
+	if opts.Concurrency > 0 {
+		zopts = append(zopts, zstd.WithEncoderConcurrency(opts.Concurrency))
+	}
+	if opts.Level != 0 {
+		zopts = append(zopts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(opts.Level)))
+	}
+	return zstd.NewWriter(w, zopts...)
+}
+
+// bzip2Type is the built-in Type registration for bzip2.
+type bzip2Type struct{}
+
+func (bzip2Type) Name() string      { return "bzip2" }
+func (bzip2Type) Extension() string { return "bz2" }
+func (bzip2Type) Magic() []byte     { return bzip2Magic }
+
+func (bzip2Type) Match(source []byte) bool {
+	return magicNumberMatcher(bzip2Magic)(source)
+}
+
+func (bzip2Type) Decompress(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(bzip2.NewReader(r)), nil
+}
+
+func (bzip2Type) Compress(w io.Writer, opts Options) (io.WriteCloser, error) {
+	var conf *dbzip2.WriterConfig
+	if opts.Level != 0 {
+		conf = &dbzip2.WriterConfig{Level: opts.Level}
+	}
+	return dbzip2.NewWriter(w, conf)
+}
+
+// xzType is the built-in Type registration for xz.
+type xzType struct{}
+
+func (xzType) Name() string      { return "xz" }
+func (xzType) Extension() string { return "xz" }
+func (xzType) Magic() []byte     { return xzMagic }
+
+func (xzType) Match(source []byte) bool {
+	return magicNumberMatcher(xzMagic)(source)
+}
+
+func (xzType) Decompress(r io.Reader) (io.ReadCloser, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	xzReader, err := xzDecompress(ctx, r)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &readCloserWrapper{
+		Reader: xzReader,
+		closer: func() error {
+			cancel()
+			return xzReader.Close()
+		},
+	}, nil
+}
+
+func (xzType) Compress(w io.Writer, opts Options) (io.WriteCloser, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	wc, err := xzCompress(ctx, w, opts.Level)
+	if err != nil {
+		cancel()
+		return nil, err
 	}
-	return ""
+	return &cancelWriteCloser{WriteCloser: wc, cancel: cancel}, nil
+}
+
+// cancelWriteCloser cancels the given context once the wrapped WriteCloser
+// has been closed, mirroring how xzDecompress/gzipDecompress tie their
+// subprocess's lifetime to the returned ReadCloser on the decompress side.
+type cancelWriteCloser struct {
+	io.WriteCloser
+	cancel context.CancelFunc
+}
+
+func (w *cancelWriteCloser) Close() error {
+	err := w.WriteCloser.Close()
+	w.cancel()
+	return err
 }
 
 func xzDecompress(ctx context.Context, archive io.Reader) (io.ReadCloser, error) {
@@ -320,6 +533,169 @@ func gzipDecompress(ctx context.Context, buf io.Reader) (io.ReadCloser, error) {
 	return cmdStream(exec.CommandContext(ctx, gzipPath, "-d", "-c"), buf)
 }
 
+var (
+	initPigzCompress sync.Once
+	pigzCompressPath string
+)
+
+// gzipCompressCommand detects pigz for compression, mirroring how
+// gzipDecompress detects unpigz/igzip for decompression. It is gated by
+// the same disablePigzEnv variable.
+func gzipCompressCommand() string {
+	initPigzCompress.Do(func() {
+		if pigzCompressPath = detectCommand("pigz", disablePigzEnv); pigzCompressPath != "" {
+			log.L.Debug("using pigz for compression")
+		}
+	})
+	return pigzCompressPath
+}
+
+func gzipCompressExternal(path string, dest io.Writer, opts Options) (io.WriteCloser, error) {
+	args := []string{path, "-c", "-q"}
+	if opts.Level != 0 {
+		args = append(args, fmt.Sprintf("-%d", opts.Level))
+	}
+	if opts.Concurrency > 0 {
+		args = append(args, "-p", strconv.Itoa(opts.Concurrency))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wc, err := cmdWriteStream(exec.CommandContext(ctx, args[0], args[1:]...), dest)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &cancelWriteCloser{WriteCloser: wc, cancel: cancel}, nil
+}
+
+// parallelGzipDefaultBlockSize is the uncompressed size of each block
+// compressed independently by parallelGzipWriter when Options.BlockSize
+// isn't set.
+const parallelGzipDefaultBlockSize = 1 << 20 // 1MiB
+
+// parallelGzipWriter compresses its input as a sequence of independent
+// gzip members, one per block, compressed concurrently by a bounded pool
+// of goroutines and written to dest in block order. Concatenated gzip
+// members form a single valid gzip stream (RFC 1952 section 2.2).
+type parallelGzipWriter struct {
+	dest      io.Writer
+	level     int
+	blockSize int
+	sem       chan struct{}
+	buf       bytes.Buffer
+	pending   []chan gzipBlockResult
+}
+
+type gzipBlockResult struct {
+	data []byte
+	err  error
+}
+
+func newParallelGzipWriter(dest io.Writer, opts Options) *parallelGzipWriter {
+	concurrency := opts.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	blockSize := opts.BlockSize
+	if blockSize <= 0 {
+		blockSize = parallelGzipDefaultBlockSize
+	}
+	return &parallelGzipWriter{
+		dest:      dest,
+		level:     opts.Level,
+		blockSize: blockSize,
+		sem:       make(chan struct{}, concurrency),
+	}
+}
+
+func (w *parallelGzipWriter) Write(p []byte) (int, error) {
+	total := len(p)
+	for len(p) > 0 {
+		free := w.blockSize - w.buf.Len()
+		if free <= 0 {
+			if err := w.submitBlock(); err != nil {
+				return total - len(p), err
+			}
+			free = w.blockSize
+		}
+		n := free
+		if n > len(p) {
+			n = len(p)
+		}
+		w.buf.Write(p[:n])
+		p = p[n:]
+	}
+	return total, nil
+}
+
+// submitBlock hands the buffered block to a worker goroutine and records
+// an ordered result channel for it, blocking to drain the oldest
+// in-flight block first once the worker pool is full so memory use stays
+// bounded.
+func (w *parallelGzipWriter) submitBlock() error {
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	block := append([]byte(nil), w.buf.Bytes()...)
+	w.buf.Reset()
+
+	if len(w.pending) >= cap(w.sem) {
+		if err := w.drainOne(); err != nil {
+			return err
+		}
+	}
+
+	result := make(chan gzipBlockResult, 1)
+	w.pending = append(w.pending, result)
+
+	level := w.level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+
+	w.sem <- struct{}{}
+	go func() {
+		defer func() { <-w.sem }()
+
+		var out bytes.Buffer
+		gw, err := gzip.NewWriterLevel(&out, level)
+		if err == nil {
+			if _, werr := gw.Write(block); werr != nil {
+				err = werr
+			} else {
+				err = gw.Close()
+			}
+		}
+		result <- gzipBlockResult{data: out.Bytes(), err: err}
+	}()
+	return nil
+}
+
+func (w *parallelGzipWriter) drainOne() error {
+	if len(w.pending) == 0 {
+		return nil
+	}
+	res := <-w.pending[0]
+	w.pending = w.pending[1:]
+	if res.err != nil {
+		return res.err
+	}
+	_, err := w.dest.Write(res.data)
+	return err
+}
+
+func (w *parallelGzipWriter) Close() error {
+	if err := w.submitBlock(); err != nil {
+		return err
+	}
+	for len(w.pending) > 0 {
+		if err := w.drainOne(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func cmdStream(cmd *exec.Cmd, in io.Reader) (io.ReadCloser, error) {
 	reader, writer := io.Pipe()
 
@@ -344,6 +720,61 @@ func cmdStream(cmd *exec.Cmd, in io.Reader) (io.ReadCloser, error) {
 	return reader, nil
 }
 
+func xzCompress(ctx context.Context, dest io.Writer, level int) (io.WriteCloser, error) {
+	args := []string{"xz", "-z", "-c", "-q"}
+	if level != 0 {
+		args = append(args, fmt.Sprintf("-%d", level))
+	}
+
+	return cmdWriteStream(exec.CommandContext(ctx, args[0], args[1:]...), dest)
+}
+
+// cmdWriteStream is the write-side counterpart of cmdStream: it feeds
+// cmd's stdin from the returned WriteCloser and streams its stdout to
+// dest, symmetrically to how cmdStream streams a command's stdout to the
+// returned ReadCloser.
+func cmdWriteStream(cmd *exec.Cmd, dest io.Writer) (io.WriteCloser, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdout = dest
+
+	var errBuf bytes.Buffer
+	cmd.Stderr = &errBuf
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	return &cmdWriteCloser{stdin: stdin, done: done, errBuf: &errBuf}, nil
+}
+
+type cmdWriteCloser struct {
+	stdin  io.WriteCloser
+	done   <-chan error
+	errBuf *bytes.Buffer
+}
+
+func (w *cmdWriteCloser) Write(p []byte) (int, error) {
+	return w.stdin.Write(p)
+}
+
+func (w *cmdWriteCloser) Close() error {
+	if err := w.stdin.Close(); err != nil {
+		return err
+	}
+	if err := <-w.done; err != nil {
+		return fmt.Errorf("%s: %s", err, w.errBuf.String())
+	}
+	return nil
+}
+
 func detectCommand(path, disableEnvName string) string {
 	// Check if this command is disabled via the env variable
 	value := os.Getenv(disableEnvName)
@@ -0,0 +1,122 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compression
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// TestDetectCompressionStable guards against registered Types whose Match
+// overlaps another Type's magic bytes: DetectCompression scans the registry
+// in registration order, so its result must be a function of the input and
+// must not change from one call to the next.
+func TestDetectCompressionStable(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := CompressStream(&buf, Zstd)
+	if err != nil {
+		t.Fatalf("CompressStream: %v", err)
+	}
+	if _, err := w.Write([]byte("some layer bytes to compress")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	for i := 0; i < 200; i++ {
+		if got := DetectCompression(buf.Bytes()); got != Zstd {
+			t.Fatalf("iteration %d: DetectCompression = %v, want Zstd", i, got)
+		}
+	}
+}
+
+// TestCompressDecompressRoundTrip exercises every registered built-in
+// format symmetrically: CompressStream followed by DecompressStream must
+// reproduce the original input and report the format it detected.
+func TestCompressDecompressRoundTrip(t *testing.T) {
+	data := []byte("round trip me through every registered compression format, please")
+
+	for _, c := range []Compression{Gzip, Zstd, Bzip2, Xz} {
+		c := c
+		t.Run(c.Extension(), func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := CompressStream(&buf, c)
+			if err != nil {
+				t.Fatalf("CompressStream: %v", err)
+			}
+			if _, err := w.Write(data); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+
+			rc, err := DecompressStream(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("DecompressStream: %v", err)
+			}
+			defer rc.Close()
+
+			if rc.GetCompression() != c {
+				t.Fatalf("GetCompression() = %v, want %v", rc.GetCompression(), c)
+			}
+
+			got, err := io.ReadAll(rc)
+			if err != nil {
+				t.Fatalf("ReadAll: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("round trip mismatch: got %q, want %q", got, data)
+			}
+		})
+	}
+}
+
+// TestParallelGzipRoundTrip checks that the concatenated gzip members
+// produced by the parallel encoder (one per block) decode back as a
+// single valid gzip stream, per RFC 1952 section 2.2.
+func TestParallelGzipRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("abcdefghij"), 10000)
+
+	var buf bytes.Buffer
+	w, err := CompressStreamWithOptions(&buf, Gzip, Options{Concurrency: 4, BlockSize: 4096})
+	if err != nil {
+		t.Fatalf("CompressStreamWithOptions: %v", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	rc, err := DecompressStream(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("DecompressStream: %v", err)
+	}
+	defer rc.Close()
+
+	got, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("parallel gzip round trip mismatch: concatenated gzip members didn't decode back to the original input")
+	}
+}
@@ -0,0 +1,171 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compression
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// Limits bounds how much a DecompressStreamWithLimits reader will produce
+// and, optionally, what the compressed input is expected to hash to. This
+// hardens callers that decompress layers from untrusted sources, where
+// DecompressStream alone will happily decompress an arbitrarily large or
+// malicious stream.
+type Limits struct {
+	// MaxDecompressedBytes caps the total number of decompressed bytes
+	// that may be produced. Zero means no limit.
+	MaxDecompressedBytes int64
+	// MaxRatio caps decompressed bytes as a multiple of compressed bytes
+	// read so far, to catch zip-bomb-style expansion. Zero means no limit.
+	MaxRatio float64
+	// ExpectedSHA256, if set, is the hex-encoded SHA256 the compressed
+	// input must hash to. It is verified once the input has been read to
+	// EOF, so it only takes effect if the caller drains the reader fully.
+	ExpectedSHA256 string
+}
+
+// LimitExceededError is returned by a Read from DecompressStreamWithLimits
+// once one of its Limits is hit.
+type LimitExceededError struct {
+	// Limit names the Limits field that was exceeded, e.g.
+	// "MaxDecompressedBytes" or "MaxRatio".
+	Limit string
+	// Value is the value reached by the read that hit the limit; that
+	// read's bytes are still returned alongside the error.
+	Value int64
+	// Bound is the configured limit that Value exceeded.
+	Bound int64
+}
+
+func (e *LimitExceededError) Error() string {
+	return fmt.Sprintf("compression: %s exceeded: %d > %d", e.Limit, e.Value, e.Bound)
+}
+
+// LimitedDecompressReadCloser is a DecompressReadCloser returned by
+// DecompressStreamWithLimits. In addition to the embedded interface, it
+// exposes how much compressed input has been read and how much
+// decompressed output has been produced so far.
+type LimitedDecompressReadCloser struct {
+	DecompressReadCloser
+
+	source   *countingReader
+	limits   Limits
+	produced int64
+}
+
+// BytesRead returns the number of compressed bytes consumed from the
+// underlying archive reader so far.
+func (r *LimitedDecompressReadCloser) BytesRead() int64 {
+	return r.source.BytesRead()
+}
+
+// BytesProduced returns the number of decompressed bytes returned to the
+// caller so far.
+func (r *LimitedDecompressReadCloser) BytesProduced() int64 {
+	return r.produced
+}
+
+func (r *LimitedDecompressReadCloser) Read(p []byte) (int, error) {
+	n, err := r.DecompressReadCloser.Read(p)
+	if n > 0 {
+		r.produced += int64(n)
+
+		if max := r.limits.MaxDecompressedBytes; max > 0 && r.produced > max {
+			return n, &LimitExceededError{Limit: "MaxDecompressedBytes", Value: r.produced, Bound: max}
+		}
+		if ratio := r.limits.MaxRatio; ratio > 0 {
+			if read := r.source.BytesRead(); read > 0 {
+				if bound := int64(ratio * float64(read)); r.produced > bound {
+					return n, &LimitExceededError{Limit: "MaxRatio", Value: r.produced, Bound: bound}
+				}
+			}
+		}
+	}
+
+	if err == io.EOF {
+		if want := r.limits.ExpectedSHA256; want != "" {
+			if got := r.source.SHA256(); got != want {
+				return n, fmt.Errorf("compression: checksum mismatch: got sha256:%s, want sha256:%s", got, want)
+			}
+		}
+	}
+
+	return n, err
+}
+
+// DecompressStreamWithLimits is DecompressStream with bounds on the
+// resulting decompression, returning a *LimitExceededError from Read once
+// one is hit.
+func DecompressStreamWithLimits(archive io.Reader, limits Limits) (*LimitedDecompressReadCloser, error) {
+	source := newCountingReader(archive, limits.ExpectedSHA256)
+
+	rc, err := DecompressStream(source)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LimitedDecompressReadCloser{
+		DecompressReadCloser: rc,
+		source:               source,
+		limits:               limits,
+	}, nil
+}
+
+// countingReader wraps an io.Reader, tracking the number of bytes read
+// through it and, if a checksum is expected, hashing them as they pass.
+type countingReader struct {
+	r    io.Reader
+	read int64
+	h    hash.Hash
+}
+
+func newCountingReader(r io.Reader, expectedSHA256 string) *countingReader {
+	cr := &countingReader{r: r}
+	if expectedSHA256 != "" {
+		cr.h = sha256.New()
+	}
+	return cr
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if n > 0 {
+		c.read += int64(n)
+		if c.h != nil {
+			c.h.Write(p[:n])
+		}
+	}
+	return n, err
+}
+
+func (c *countingReader) BytesRead() int64 {
+	return c.read
+}
+
+// SHA256 returns the hex-encoded SHA256 of the bytes read so far. It is
+// only meaningful when the countingReader was created with an expected
+// checksum to verify.
+func (c *countingReader) SHA256() string {
+	if c.h == nil {
+		return ""
+	}
+	return hex.EncodeToString(c.h.Sum(nil))
+}
@@ -0,0 +1,135 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compression
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestDecompressStreamWithLimitsMaxDecompressedBytes(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := CompressStream(&buf, Gzip)
+	if err != nil {
+		t.Fatalf("CompressStream: %v", err)
+	}
+	if _, err := w.Write(bytes.Repeat([]byte("x"), 1024)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	rc, err := DecompressStreamWithLimits(bytes.NewReader(buf.Bytes()), Limits{MaxDecompressedBytes: 100})
+	if err != nil {
+		t.Fatalf("DecompressStreamWithLimits: %v", err)
+	}
+	defer rc.Close()
+
+	_, err = io.ReadAll(rc)
+	var limitErr *LimitExceededError
+	if !errors.As(err, &limitErr) {
+		t.Fatalf("err = %v, want a *LimitExceededError", err)
+	}
+	if limitErr.Limit != "MaxDecompressedBytes" {
+		t.Fatalf("Limit = %q, want MaxDecompressedBytes", limitErr.Limit)
+	}
+}
+
+// TestDecompressStreamWithLimitsMaxRatio guards the zip-bomb-style
+// expansion check: a highly repetitive payload compresses to a tiny
+// fraction of its decompressed size, so a low MaxRatio must trip well
+// before the whole payload is read.
+func TestDecompressStreamWithLimitsMaxRatio(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := CompressStream(&buf, Gzip)
+	if err != nil {
+		t.Fatalf("CompressStream: %v", err)
+	}
+	if _, err := w.Write(bytes.Repeat([]byte{0}, 1<<20)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	rc, err := DecompressStreamWithLimits(bytes.NewReader(buf.Bytes()), Limits{MaxRatio: 2})
+	if err != nil {
+		t.Fatalf("DecompressStreamWithLimits: %v", err)
+	}
+	defer rc.Close()
+
+	_, err = io.ReadAll(rc)
+	var limitErr *LimitExceededError
+	if !errors.As(err, &limitErr) {
+		t.Fatalf("err = %v, want a *LimitExceededError", err)
+	}
+	if limitErr.Limit != "MaxRatio" {
+		t.Fatalf("Limit = %q, want MaxRatio", limitErr.Limit)
+	}
+}
+
+func TestDecompressStreamWithLimitsChecksum(t *testing.T) {
+	var compressed bytes.Buffer
+	w, err := CompressStream(&compressed, Gzip)
+	if err != nil {
+		t.Fatalf("CompressStream: %v", err)
+	}
+	data := []byte("checksum me")
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	sum := sha256.Sum256(compressed.Bytes())
+	want := hex.EncodeToString(sum[:])
+
+	rc, err := DecompressStreamWithLimits(bytes.NewReader(compressed.Bytes()), Limits{ExpectedSHA256: want})
+	if err != nil {
+		t.Fatalf("DecompressStreamWithLimits: %v", err)
+	}
+	defer rc.Close()
+
+	got, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("round trip mismatch: got %q, want %q", got, data)
+	}
+	if rc.BytesProduced() != int64(len(data)) {
+		t.Fatalf("BytesProduced() = %d, want %d", rc.BytesProduced(), len(data))
+	}
+	if rc.BytesRead() == 0 {
+		t.Fatal("BytesRead() = 0, want > 0")
+	}
+
+	rc2, err := DecompressStreamWithLimits(bytes.NewReader(compressed.Bytes()), Limits{ExpectedSHA256: "deadbeef"})
+	if err != nil {
+		t.Fatalf("DecompressStreamWithLimits: %v", err)
+	}
+	defer rc2.Close()
+	if _, err := io.ReadAll(rc2); err == nil {
+		t.Fatal("expected a checksum mismatch error once the input was fully read")
+	}
+}
@@ -0,0 +1,117 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compression
+
+import (
+	"io"
+	"strings"
+)
+
+// ZstdChunked identifies zstd streams written in the seekable format
+// (CompressStreamSeekable / NewSeekableReader). It exists as a distinct
+// Compression so registry/fetcher code can negotiate a random-access-capable
+// layer instead of a plain zstd one.
+var ZstdChunked = Register(zstdChunkedType{})
+
+type zstdChunkedType struct {
+	zstdType
+}
+
+func (zstdChunkedType) Name() string { return "zstd:chunked" }
+
+// Match always reports false: the seekable index that distinguishes a
+// zstd:chunked stream from a plain zstd one is a footer at the end of the
+// stream (see IsSeekableZstd), and Match only ever sees a short prefix from
+// the front. Matching on the shared zstd magic bytes here would make
+// DetectCompression report ZstdChunked for every zstd stream: ZstdChunked
+// is registered during package variable initialization, before init
+// registers the built-in Zstd, and overlaps resolve in registration order.
+// Callers that need to tell them apart have an io.ReaderAt and the stream
+// size on hand (e.g. a pulled layer) and should call IsSeekableZstd
+// directly instead of relying on header sniffing.
+func (zstdChunkedType) Match(source []byte) bool {
+	return false
+}
+
+// Compress writes dest as a seekable zstd stream (CompressStreamSeekable),
+// honoring opts.BlockSize as the chunk size; it does not fall back to
+// zstdType's plain, non-indexed writer.
+func (zstdChunkedType) Compress(w io.Writer, opts Options) (io.WriteCloser, error) {
+	chunkSize := opts.BlockSize
+	if chunkSize <= 0 {
+		chunkSize = seekableDefaultChunkSize
+	}
+	return &seekableWriter{dest: w, chunkSize: chunkSize}, nil
+}
+
+// Decompress reads a zstd:chunked stream linearly like plain zstd. This is
+// intentional, not an oversight: the trailing index is carried in a zstd
+// skippable frame, which a regular zstd decoder safely skips over, so a
+// streaming io.Reader decode needs no special handling. Random access into
+// individual chunks instead requires an io.ReaderAt and the stream size, and
+// should go through NewSeekableReader directly rather than this Type, since
+// the Type interface's Decompress has no way to express seeking.
+func (zstdChunkedType) Decompress(r io.Reader) (io.ReadCloser, error) {
+	return zstdType{}.Decompress(r)
+}
+
+// MediaTypeFor returns the OCI media-type suffix (e.g. "+gzip", "+zstd",
+// "+zstd:chunked") for the given compression. It returns the empty string
+// for Uncompressed or for a Compression that isn't registered.
+func MediaTypeFor(c Compression) string {
+	if c == Uncompressed {
+		return ""
+	}
+	t, ok := lookup(c)
+	if !ok {
+		return ""
+	}
+	return "+" + t.Name()
+}
+
+// NegotiateCompression picks the first entry of accept, an Accept-Encoding
+// style preference list ordered from most to least preferred (e.g. from a
+// registry's advertised layer variants), whose name matches one of the
+// Compressions in available. It returns Uncompressed if nothing matches,
+// so callers can fall back to an uncompressed layer.
+func NegotiateCompression(accept []string, available []Compression) Compression {
+	offered := make(map[string]Compression, len(available))
+	for _, c := range available {
+		if c == Uncompressed {
+			offered["identity"] = c
+			continue
+		}
+		if t, ok := lookup(c); ok {
+			offered[strings.ToLower(t.Name())] = c
+		}
+	}
+
+	for _, a := range accept {
+		name := strings.ToLower(strings.TrimSpace(a))
+		// Strip an Accept-Encoding-style quality suffix, e.g. "gzip;q=0.8".
+		if i := strings.IndexByte(name, ';'); i >= 0 {
+			name = strings.TrimSpace(name[:i])
+		}
+		if name == "*" && len(available) > 0 {
+			return available[0]
+		}
+		if c, ok := offered[name]; ok {
+			return c
+		}
+	}
+	return Uncompressed
+}
@@ -0,0 +1,62 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compression
+
+import "testing"
+
+func TestMediaTypeFor(t *testing.T) {
+	cases := []struct {
+		c    Compression
+		want string
+	}{
+		{Uncompressed, ""},
+		{Gzip, "+gzip"},
+		{Zstd, "+zstd"},
+		{Bzip2, "+bzip2"},
+		{Xz, "+xz"},
+		{ZstdChunked, "+zstd:chunked"},
+	}
+	for _, tc := range cases {
+		if got := MediaTypeFor(tc.c); got != tc.want {
+			t.Errorf("MediaTypeFor(%v) = %q, want %q", tc.c, got, tc.want)
+		}
+	}
+}
+
+func TestNegotiateCompression(t *testing.T) {
+	available := []Compression{Gzip, Zstd, ZstdChunked}
+
+	cases := []struct {
+		name   string
+		accept []string
+		want   Compression
+	}{
+		{"exact match, first preference wins", []string{"zstd", "gzip"}, Zstd},
+		{"falls through to a later preference", []string{"xz", "gzip"}, Gzip},
+		{"case insensitive with a quality suffix", []string{"GZIP;q=0.9"}, Gzip},
+		{"wildcard picks the first available", []string{"*"}, Gzip},
+		{"no match falls back to uncompressed", []string{"br"}, Uncompressed},
+		{"chunked name matches its own entry", []string{"zstd:chunked"}, ZstdChunked},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := NegotiateCompression(tc.accept, available); got != tc.want {
+				t.Errorf("NegotiateCompression(%v, %v) = %v, want %v", tc.accept, available, got, tc.want)
+			}
+		})
+	}
+}
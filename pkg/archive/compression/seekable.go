@@ -0,0 +1,374 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compression
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Seekable zstd streams, as used by zstd:chunked and estargz-style layers,
+// are a sequence of independent zstd frames followed by a skippable frame
+// carrying an index of decompressed->compressed offsets and a small fixed
+// footer, in a skippable frame of its own, pointing back at that index. Decoders unaware of this layout still
+// see a linearly-decompressible zstd stream, since skippable frames are part
+// of the zstd format (see zstdMatcher); readers that want random access
+// instead locate the footer and jump straight to the index without
+// decompressing the payload.
+const (
+	seekableIndexFrameMagic uint32 = zstdMagicSkippableStart
+	seekableFooterMagic     uint32 = 0x53454b5a // "SEKZ"
+	seekableFooterVersion   byte   = 1
+	seekableFooterSize             = 8 + 4 + 4 + 1 // indexOffset + indexSize + magic + version
+
+	// seekableDefaultChunkSize is the uncompressed size of each independent
+	// frame written by CompressStreamSeekable, chosen to match the chunk
+	// sizing typically used by estargz-style layers.
+	seekableDefaultChunkSize = 4 << 20 // 4MiB
+)
+
+// chunkEntry records the decompressed/compressed offset pair for the start
+// of one independently-decompressible zstd frame ("chunk") in a seekable
+// stream.
+type chunkEntry struct {
+	UncompressedOffset int64
+	CompressedOffset   int64
+}
+
+// SeekableDecompressor provides random-access reads into a zstd stream
+// produced by CompressStreamSeekable: a sequence of independent zstd frames
+// plus a trailing index, as used by zstd:chunked and estargz-style layers.
+type SeekableDecompressor struct {
+	ra      io.ReaderAt
+	size    int64
+	index   []chunkEntry
+	dataEnd int64 // end offset of the last data frame, i.e. start of the index frame
+	total   int64 // total uncompressed size, from the index trailer
+}
+
+// IsSeekableZstd reports whether the zstd stream in ra (of the given total
+// size) carries the trailing seekable index footer written by
+// CompressStreamSeekable. It performs a small bounded read of the last
+// seekableFooterSize bytes rather than parsing the whole stream, so it's
+// cheap to call before choosing between NewSeekableReader and a regular
+// DecompressStream. Unlike Type.Match, which only ever sees a short prefix
+// of the stream, this check needs random access to the tail and so cannot
+// be done from header bytes alone.
+func IsSeekableZstd(ra io.ReaderAt, size int64) bool {
+	footer, err := readSeekableFooter(ra, size)
+	return err == nil && footer != nil
+}
+
+// readSeekableFooter reads and validates the fixed-size footer at the end
+// of a seekable zstd stream, returning its raw bytes for decoding by the
+// caller. It returns a nil footer (no error) if size is too small to hold
+// one at all, and an error if a footer-sized read was attempted but didn't
+// parse as one.
+func readSeekableFooter(ra io.ReaderAt, size int64) ([]byte, error) {
+	if size < seekableFooterSize {
+		return nil, nil
+	}
+
+	footer := make([]byte, seekableFooterSize)
+	if _, err := ra.ReadAt(footer, size-seekableFooterSize); err != nil {
+		return nil, fmt.Errorf("compression: reading seekable footer: %w", err)
+	}
+
+	if binary.LittleEndian.Uint32(footer[12:16]) != seekableFooterMagic {
+		return nil, errors.New("compression: not a seekable zstd stream")
+	}
+	if footer[16] != seekableFooterVersion {
+		return nil, fmt.Errorf("compression: unsupported seekable index version %d", footer[16])
+	}
+	return footer, nil
+}
+
+// NewSeekableReader parses the trailing skippable index frame of a seekable
+// zstd stream and returns a SeekableDecompressor that can fetch individual
+// chunks via ReadAt without decompressing the whole layer.
+func NewSeekableReader(ra io.ReaderAt, size int64) (*SeekableDecompressor, error) {
+	footer, err := readSeekableFooter(ra, size)
+	if err != nil {
+		return nil, err
+	}
+	if footer == nil {
+		return nil, errors.New("compression: stream too small to contain a seekable index")
+	}
+
+	indexOffset := int64(binary.LittleEndian.Uint64(footer[0:8]))
+	indexSize := int64(binary.LittleEndian.Uint32(footer[8:12]))
+	if indexOffset < 0 || indexSize < 0 || indexOffset+indexSize > size-seekableFooterSize {
+		return nil, errors.New("compression: corrupt seekable index offsets")
+	}
+
+	frame := make([]byte, indexSize)
+	if _, err := ra.ReadAt(frame, indexOffset); err != nil {
+		return nil, fmt.Errorf("compression: reading seekable index frame: %w", err)
+	}
+
+	entries, total, err := parseSeekableIndexFrame(frame)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SeekableDecompressor{
+		ra:      ra,
+		size:    size,
+		index:   entries,
+		dataEnd: indexOffset,
+		total:   total,
+	}, nil
+}
+
+// Size returns the total uncompressed size of the stream.
+func (s *SeekableDecompressor) Size() int64 {
+	return s.total
+}
+
+// ReadAt implements io.ReaderAt over the uncompressed stream, decompressing
+// only the chunk(s) that overlap [off, off+len(p)).
+func (s *SeekableDecompressor) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("compression: negative offset")
+	}
+	if off >= s.total {
+		return 0, io.EOF
+	}
+
+	var n int
+	for n < len(p) && off+int64(n) < s.total {
+		idx := s.chunkFor(off + int64(n))
+		if idx < 0 {
+			return n, errors.New("compression: offset not covered by seekable index")
+		}
+
+		read, err := s.readChunk(idx, off+int64(n)-s.index[idx].UncompressedOffset, p[n:])
+		n += read
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return n, err
+		}
+		if read == 0 && err == nil {
+			// Defensive: avoid spinning if a chunk yields nothing.
+			return n, io.ErrNoProgress
+		}
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// chunkFor returns the index of the chunk covering the given uncompressed
+// offset, or -1 if off precedes the first chunk.
+func (s *SeekableDecompressor) chunkFor(off int64) int {
+	i, j := 0, len(s.index)
+	for i < j {
+		m := (i + j) / 2
+		if s.index[m].UncompressedOffset <= off {
+			i = m + 1
+		} else {
+			j = m
+		}
+	}
+	return i - 1
+}
+
+// readChunk decompresses chunk idx, discards the first skip uncompressed
+// bytes, and copies the remainder into p.
+func (s *SeekableDecompressor) readChunk(idx int, skip int64, p []byte) (int, error) {
+	entry := s.index[idx]
+	compEnd := s.dataEnd
+	if idx+1 < len(s.index) {
+		compEnd = s.index[idx+1].CompressedOffset
+	}
+
+	zr, err := zstd.NewReader(io.NewSectionReader(s.ra, entry.CompressedOffset, compEnd-entry.CompressedOffset))
+	if err != nil {
+		return 0, err
+	}
+	defer zr.Close()
+
+	if skip > 0 {
+		if _, err := io.CopyN(io.Discard, zr, skip); err != nil {
+			return 0, err
+		}
+	}
+	return io.ReadFull(zr, p)
+}
+
+// CompressStreamSeekable compresses dest using zstd, writing a sequence of
+// independently-decompressible frames followed by a trailing index frame,
+// so that the result can later be opened with NewSeekableReader and read
+// with ReadAt without decompressing the whole stream.
+func CompressStreamSeekable(dest io.Writer) (io.WriteCloser, error) {
+	return &seekableWriter{dest: dest, chunkSize: seekableDefaultChunkSize}, nil
+}
+
+type seekableWriter struct {
+	dest      io.Writer
+	chunkSize int
+	buf       bytes.Buffer
+
+	index              []chunkEntry
+	uncompressedOffset int64
+	compressedOffset   int64
+}
+
+func (w *seekableWriter) Write(p []byte) (int, error) {
+	total := len(p)
+	for len(p) > 0 {
+		free := w.chunkSize - w.buf.Len()
+		if free <= 0 {
+			if err := w.flushChunk(); err != nil {
+				return total - len(p), err
+			}
+			free = w.chunkSize
+		}
+		n := free
+		if n > len(p) {
+			n = len(p)
+		}
+		w.buf.Write(p[:n])
+		p = p[n:]
+	}
+	return total, nil
+}
+
+// flushChunk compresses the buffered bytes as one independent zstd frame
+// and writes it to dest, recording its offsets in the index.
+func (w *seekableWriter) flushChunk() error {
+	if w.buf.Len() == 0 {
+		return nil
+	}
+
+	w.index = append(w.index, chunkEntry{
+		UncompressedOffset: w.uncompressedOffset,
+		CompressedOffset:   w.compressedOffset,
+	})
+
+	var compressed bytes.Buffer
+	zw, err := zstd.NewWriter(&compressed)
+	if err != nil {
+		return err
+	}
+	if _, err := zw.Write(w.buf.Bytes()); err != nil {
+		zw.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	w.uncompressedOffset += int64(w.buf.Len())
+	w.buf.Reset()
+
+	n, err := w.dest.Write(compressed.Bytes())
+	w.compressedOffset += int64(n)
+	return err
+}
+
+// Close flushes any remaining buffered data, appends the index skippable
+// frame, and writes the footer that lets NewSeekableReader find it, wrapped
+// in a second skippable frame.
+func (w *seekableWriter) Close() error {
+	if err := w.flushChunk(); err != nil {
+		return err
+	}
+
+	indexOffset := w.compressedOffset
+	frame := encodeSeekableIndexFrame(w.index, w.uncompressedOffset, w.compressedOffset)
+	n, err := w.dest.Write(frame)
+	if err != nil {
+		return err
+	}
+
+	footer := make([]byte, seekableFooterSize)
+	binary.LittleEndian.PutUint64(footer[0:8], uint64(indexOffset))
+	binary.LittleEndian.PutUint32(footer[8:12], uint32(n))
+	binary.LittleEndian.PutUint32(footer[12:16], seekableFooterMagic)
+	footer[16] = seekableFooterVersion
+
+	// The footer goes in a skippable frame of its own, so the stream ends on
+	// a frame boundary; readSeekableFooter reads only its payload.
+	var footerHeader [8]byte
+	binary.LittleEndian.PutUint32(footerHeader[0:4], seekableIndexFrameMagic)
+	binary.LittleEndian.PutUint32(footerHeader[4:8], seekableFooterSize)
+	if _, err := w.dest.Write(footerHeader[:]); err != nil {
+		return err
+	}
+	_, err = w.dest.Write(footer)
+	return err
+}
+
+func encodeSeekableIndexFrame(entries []chunkEntry, totalUncompressed, totalCompressed int64) []byte {
+	content := make([]byte, 4, 4+len(entries)*16+16)
+	binary.LittleEndian.PutUint32(content[0:4], uint32(len(entries)))
+	for _, e := range entries {
+		var buf [16]byte
+		binary.LittleEndian.PutUint64(buf[0:8], uint64(e.UncompressedOffset))
+		binary.LittleEndian.PutUint64(buf[8:16], uint64(e.CompressedOffset))
+		content = append(content, buf[:]...)
+	}
+	var trailer [16]byte
+	binary.LittleEndian.PutUint64(trailer[0:8], uint64(totalUncompressed))
+	binary.LittleEndian.PutUint64(trailer[8:16], uint64(totalCompressed))
+	content = append(content, trailer[:]...)
+
+	frame := make([]byte, 8+len(content))
+	binary.LittleEndian.PutUint32(frame[0:4], seekableIndexFrameMagic)
+	binary.LittleEndian.PutUint32(frame[4:8], uint32(len(content)))
+	copy(frame[8:], content)
+	return frame
+}
+
+func parseSeekableIndexFrame(frame []byte) ([]chunkEntry, int64, error) {
+	if len(frame) < 8 {
+		return nil, 0, errors.New("compression: seekable index frame too short")
+	}
+	if binary.LittleEndian.Uint32(frame[0:4])&zstdMagicSkippableMask != zstdMagicSkippableStart {
+		return nil, 0, errors.New("compression: seekable index is not a skippable frame")
+	}
+
+	size := binary.LittleEndian.Uint32(frame[4:8])
+	content := frame[8:]
+	if uint32(len(content)) != size {
+		return nil, 0, errors.New("compression: seekable index frame size mismatch")
+	}
+	if len(content) < 4 {
+		return nil, 0, errors.New("compression: seekable index frame missing entry count")
+	}
+
+	numEntries := int(binary.LittleEndian.Uint32(content[0:4]))
+	content = content[4:]
+	if numEntries < 0 || len(content) != numEntries*16+16 {
+		return nil, 0, errors.New("compression: seekable index frame malformed")
+	}
+
+	entries := make([]chunkEntry, numEntries)
+	for i := range entries {
+		entries[i].UncompressedOffset = int64(binary.LittleEndian.Uint64(content[i*16 : i*16+8]))
+		entries[i].CompressedOffset = int64(binary.LittleEndian.Uint64(content[i*16+8 : i*16+16]))
+	}
+
+	total := int64(binary.LittleEndian.Uint64(content[numEntries*16 : numEntries*16+8]))
+	return entries, total, nil
+}
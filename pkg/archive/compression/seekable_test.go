@@ -0,0 +1,135 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compression
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestParseSeekableIndexFrameRoundTrip(t *testing.T) {
+	entries := []chunkEntry{
+		{UncompressedOffset: 0, CompressedOffset: 0},
+		{UncompressedOffset: 100, CompressedOffset: 40},
+		{UncompressedOffset: 250, CompressedOffset: 90},
+	}
+	frame := encodeSeekableIndexFrame(entries, 400, 150)
+
+	got, total, err := parseSeekableIndexFrame(frame)
+	if err != nil {
+		t.Fatalf("parseSeekableIndexFrame: %v", err)
+	}
+	if total != 400 {
+		t.Fatalf("total = %d, want 400", total)
+	}
+	if len(got) != len(entries) {
+		t.Fatalf("got %d entries, want %d", len(got), len(entries))
+	}
+	for i, e := range entries {
+		if got[i] != e {
+			t.Fatalf("entry %d = %+v, want %+v", i, got[i], e)
+		}
+	}
+}
+
+func TestParseSeekableIndexFrameRejectsGarbage(t *testing.T) {
+	if _, _, err := parseSeekableIndexFrame([]byte{0, 1, 2, 3}); err == nil {
+		t.Fatal("expected an error for a frame with no valid skippable magic")
+	}
+}
+
+func TestIsSeekableZstd(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := CompressStreamSeekable(&buf)
+	if err != nil {
+		t.Fatalf("CompressStreamSeekable: %v", err)
+	}
+	if _, err := w.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if !IsSeekableZstd(bytes.NewReader(buf.Bytes()), int64(buf.Len())) {
+		t.Fatal("IsSeekableZstd = false for a stream written by CompressStreamSeekable")
+	}
+
+	plain := []byte("not a seekable zstd stream at all, just plain bytes")
+	if IsSeekableZstd(bytes.NewReader(plain), int64(len(plain))) {
+		t.Fatal("IsSeekableZstd = true for non-seekable input")
+	}
+}
+
+func TestSeekableReaderReadAt(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := CompressStreamSeekable(&buf)
+	if err != nil {
+		t.Fatalf("CompressStreamSeekable: %v", err)
+	}
+	// Small chunk size so the payload spans several independent chunks.
+	w.(*seekableWriter).chunkSize = 16
+
+	data := []byte("the quick brown fox jumps over the lazy dog, repeatedly, to span several chunks")
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	ra := bytes.NewReader(buf.Bytes())
+	sr, err := NewSeekableReader(ra, int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("NewSeekableReader: %v", err)
+	}
+	if sr.Size() != int64(len(data)) {
+		t.Fatalf("Size() = %d, want %d", sr.Size(), len(data))
+	}
+
+	t.Run("full read", func(t *testing.T) {
+		got := make([]byte, len(data))
+		if _, err := sr.ReadAt(got, 0); err != nil && err != io.EOF {
+			t.Fatalf("ReadAt: %v", err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("ReadAt(0) = %q, want %q", got, data)
+		}
+	})
+
+	t.Run("partial read crossing a chunk boundary", func(t *testing.T) {
+		off, n := int64(20), 30
+		got := make([]byte, n)
+		read, err := sr.ReadAt(got, off)
+		if err != nil && err != io.EOF {
+			t.Fatalf("ReadAt: %v", err)
+		}
+		if read != n {
+			t.Fatalf("read %d bytes, want %d", read, n)
+		}
+		if want := data[off : off+int64(n)]; !bytes.Equal(got, want) {
+			t.Fatalf("ReadAt(%d) = %q, want %q", off, got, want)
+		}
+	})
+
+	t.Run("read at end of stream returns io.EOF", func(t *testing.T) {
+		if _, err := sr.ReadAt(make([]byte, 1), int64(len(data))); err != io.EOF {
+			t.Fatalf("err = %v, want io.EOF", err)
+		}
+	})
+}